@@ -1,10 +1,18 @@
 package corehttp
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	gopath "path"
 	"strings"
 	"time"
@@ -17,7 +25,7 @@ import (
 	"github.com/ipfs/go-ipfs/importer"
 	chunk "github.com/ipfs/go-ipfs/importer/chunk"
 	dag "github.com/ipfs/go-ipfs/merkledag"
-	dagutils "github.com/ipfs/go-ipfs/merkledag/utils"
+	"github.com/ipfs/go-ipfs/mfs"
 	path "github.com/ipfs/go-ipfs/path"
 	"github.com/ipfs/go-ipfs/routing"
 	uio "github.com/ipfs/go-ipfs/unixfs/io"
@@ -43,6 +51,156 @@ func newGatewayHandler(node *core.IpfsNode, conf GatewayConfig) (*gatewayHandler
 	return i, nil
 }
 
+// SubdomainGatewayOption returns a ServeOption that serves the gateway on
+// <root>.ipfs.<gatewayHost> and <root>.ipns.<gatewayHost> subdomains instead
+// of (or in addition to, if registered alongside GatewayOption) path-style
+// /ipfs/<root> and /ipns/<root> routes. Giving every root its own subdomain
+// gives it its own browser origin, which sandboxes cookies, localStorage,
+// and service workers between dapps -- something the Suborigin header set
+// in getOrHeadHandler can't do now that browsers have dropped Suborigin
+// support.
+//
+// A subdomain like <cid>.ipfs.gatewayHost has gatewayHost as a *suffix* of
+// its Host header, not a prefix, so it can't be matched by registering a
+// host-qualified pattern on the shared http.ServeMux (ServeMux only ever
+// matches a pattern against the start of the Host+path). Instead this
+// returns a fresh mux whose single "/" handler inspects r.Host on every
+// request, and falls back to the mux passed in for anything that isn't
+// gatewayHost or one of its subdomains.
+func SubdomainGatewayOption(gatewayHost string, conf GatewayConfig) ServeOption {
+	return func(n *core.IpfsNode, l net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		gateway, err := newGatewayHandler(n, conf)
+		if err != nil {
+			return nil, err
+		}
+
+		wrapped := http.NewServeMux()
+		wrapped.Handle("/", subdomainGatewayHandler(gatewayHost, gateway, mux))
+		return wrapped, nil
+	}
+}
+
+// subdomainGatewayHandler wraps gateway so that a request to
+// <root>.ipfs.<gatewayHost>/sub/path is rewritten to /ipfs/<root>/sub/path
+// (and likewise for .ipns.) before reaching it, while a path-style request
+// made directly to gatewayHost is 301-redirected to its subdomain
+// equivalent. Any request whose Host isn't gatewayHost or a subdomain of it
+// is passed through to fallback untouched.
+func subdomainGatewayHandler(gatewayHost string, gateway *gatewayHandler, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := stripPort(r.Host)
+
+		if host == gatewayHost {
+			if redirectURL, ok := subdomainRedirectURL(gatewayHost, r.URL); ok {
+				http.Redirect(w, r, redirectURL, http.StatusMovedPermanently)
+				return
+			}
+			gateway.ServeHTTP(w, r)
+			return
+		}
+
+		rootID, ns, ok := parseSubdomainHost(host, gatewayHost)
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		pathRoot := rootID
+		if ns == "ipfs" {
+			k, err := subdomainDecode(rootID)
+			if err != nil {
+				http.Error(w, "invalid CID in subdomain: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			pathRoot = k.B58String()
+		}
+
+		originalPath := r.URL.Path
+		// See the X-IPNS-Original-Path handling in getOrHeadHandler: it needs
+		// the request as the client actually made it to build correct
+		// redirects and links back out.
+		r.Header.Set("X-IPNS-Original-Path", originalPath)
+		r.URL.Path = "/" + ns + "/" + pathRoot + originalPath
+		gateway.ServeHTTP(w, r)
+	})
+}
+
+// parseSubdomainHost splits a Host header of the form
+// <rootID>.<ipfs|ipns>.<gatewayHost> into its rootID and namespace. ok is
+// false if host isn't a subdomain of gatewayHost in that shape.
+func parseSubdomainHost(host, gatewayHost string) (rootID, ns string, ok bool) {
+	suffix := "." + gatewayHost
+	if !strings.HasSuffix(host, suffix) {
+		return "", "", false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, suffix), ".")
+	if len(labels) != 2 {
+		return "", "", false
+	}
+
+	rootID, ns = labels[0], labels[1]
+	if ns != "ipfs" && ns != "ipns" {
+		return "", "", false
+	}
+	return rootID, ns, true
+}
+
+// subdomainRedirectURL builds the subdomain equivalent of a path-style
+// /ipfs/<root>/... or /ipns/<root>/... URL on gatewayHost, or returns
+// ok=false if u isn't path-style.
+func subdomainRedirectURL(gatewayHost string, u *url.URL) (string, bool) {
+	var ns, rest string
+	switch {
+	case strings.HasPrefix(u.Path, ipfsPathPrefix):
+		ns, rest = "ipfs", strings.TrimPrefix(u.Path, ipfsPathPrefix)
+	case strings.HasPrefix(u.Path, ipnsPathPrefix):
+		ns, rest = "ipns", strings.TrimPrefix(u.Path, ipnsPathPrefix)
+	default:
+		return "", false
+	}
+
+	segs := strings.SplitN(rest, "/", 2)
+	rootID := segs[0]
+	if ns == "ipfs" {
+		rootID = subdomainEncode(key.B58KeyDecode(rootID))
+	}
+
+	sub := url.URL{Scheme: "https", Host: rootID + "." + ns + "." + gatewayHost, RawQuery: u.RawQuery}
+	if len(segs) > 1 {
+		sub.Path = "/" + segs[1]
+	}
+	return sub.String(), true
+}
+
+// stripPort drops any :port suffix from a Host header.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// subdomainBase32 is the DNS-label-safe encoding used for a key.Key in a
+// gateway subdomain. This tree predates the cid/multibase packages, so a
+// real CIDv1 "base32" representation isn't available; a lowercase,
+// unpadded RFC4648 base32 encoding of the same multihash bytes gives the
+// subdomain the property that actually matters here (fits in one DNS
+// label, no "/" to be misparsed as a path).
+var subdomainBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func subdomainEncode(k key.Key) string {
+	return strings.ToLower(subdomainBase32.EncodeToString([]byte(k)))
+}
+
+func subdomainDecode(s string) (key.Key, error) {
+	raw, err := subdomainBase32.DecodeString(strings.ToUpper(s))
+	if err != nil {
+		return "", err
+	}
+	return key.Key(raw), nil
+}
+
 // TODO(cryptix):  find these helpers somewhere else
 func (i *gatewayHandler) newDagFromReader(r io.Reader) (*dag.Node, error) {
 	// TODO(cryptix): change and remove this helper once PR1136 is merged
@@ -58,36 +216,139 @@ func (i *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(i.node.Context())
 	defer cancel()
 
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		log.Infof("from=%s method=%s path=%s cid=%s status=%d bytes=%d duration=%s",
+			r.RequestURI, r.Method, r.URL.Path, sw.cid, sw.status, sw.bytes, time.Since(start))
+	}()
+
 	if i.config.Writable {
 		switch r.Method {
 		case "POST":
-			i.postHandler(ctx, w, r)
+			i.postHandler(ctx, sw, r)
 			return
 		case "PUT":
-			// TODO(cryptix): where are the docs?
-			http.Error(w, "writableGateway: PUT method not meaningful on IPFS - use POST and see the docs", http.StatusMethodNotAllowed)
+			i.putHandler(ctx, sw, r)
 			return
 		case "DELETE":
-			i.deleteHandler(ctx, w, r)
+			i.deleteHandler(ctx, sw, r)
 			return
 		}
 	}
 
 	if r.Method == "GET" || r.Method == "HEAD" {
-		i.getOrHeadHandler(w, r)
+		i.getOrHeadHandler(sw, r)
 		return
 	}
 
 	errmsg := "Method " + r.Method + " not allowed: "
 	if !i.config.Writable {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		sw.WriteHeader(http.StatusMethodNotAllowed)
 		errmsg = errmsg + "read only access"
 	} else {
-		w.WriteHeader(http.StatusBadRequest)
+		sw.WriteHeader(http.StatusBadRequest)
 		errmsg = errmsg + "bad request for " + r.URL.Path
 	}
-	fmt.Fprint(w, errmsg)
-	log.Error(errmsg) // TODO(cryptix): log errors until we have a better way to expose these (counter metrics maybe)
+	fmt.Fprint(sw, errmsg)
+}
+
+// statusWriter wraps http.ResponseWriter to capture the status code and
+// byte count of everything written through it -- including redirects from
+// http.Redirect/http.ServeContent, which don't otherwise expose what they
+// sent -- plus the resolved cid once a handler knows it, so ServeHTTP can
+// log one structured, request-scoped line when the request finishes.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	cid    string
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// setResolvedCid records the cid a handler resolved for this request, for
+// ServeHTTP's completion log line. It's a no-op if w isn't a *statusWriter,
+// which only happens in tests that call a handler directly.
+func setResolvedCid(w http.ResponseWriter, k key.Key) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.cid = k.String()
+	}
+}
+
+// serverTiming accumulates Server-Timing entries across the phases of a
+// gateway request (resolve, dagread, serve) so operators can diagnose a
+// slow response without reaching for external tracing.
+type serverTiming struct {
+	entries []string
+}
+
+func (t *serverTiming) record(name string, since time.Time) {
+	t.entries = append(t.entries, fmt.Sprintf("%s;dur=%.2f", name, float64(time.Since(since))/float64(time.Millisecond)))
+}
+
+func (t *serverTiming) writeHeader(w http.ResponseWriter) {
+	if len(t.entries) > 0 {
+		w.Header().Set("Server-Timing", strings.Join(t.entries, ", "))
+	}
+}
+
+// declareTrailer predeclares Server-Timing as an HTTP trailer. Call this
+// before writing the response body whenever a "serve" phase is still going
+// to be recorded: net/http silently drops Header() mutations made after the
+// first Write/WriteHeader, so a plain response header set before the body
+// would never carry the serve;dur= entry. Setting the *same* header key
+// again, after the body, is instead honored as the trailer value.
+func (t *serverTiming) declareTrailer(w http.ResponseWriter) {
+	w.Header().Set("Trailer", "Server-Timing")
+}
+
+// flush sets the accumulated entries as the Server-Timing trailer value.
+// Must be called after declareTrailer and after the response body has been
+// written.
+func (t *serverTiming) flush(w http.ResponseWriter) {
+	if len(t.entries) > 0 {
+		w.Header().Set("Server-Timing", strings.Join(t.entries, ", "))
+	}
+}
+
+// noContentLengthWriter strips any Content-Length header the wrapped
+// handler sets right before the header actually goes out, forcing net/http
+// to fall back to chunked transfer encoding. net/http only honors a
+// trailer declared via declareTrailer when the response is chunked; with a
+// Content-Length present (as http.ServeContent sets for any seekable
+// reader) it silently drops the trailer instead, so the serve;dur= entry
+// never reaches the client on the single most common gateway request --
+// serving a plain file.
+type noContentLengthWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *noContentLengthWriter) WriteHeader(status int) {
+	w.Header().Del("Content-Length")
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *noContentLengthWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.Header().Del("Content-Length")
+		w.wroteHeader = true
+	}
+	return w.ResponseWriter.Write(b)
 }
 
 func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request) {
@@ -115,12 +376,20 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	timing := &serverTiming{}
+
+	resolveStart := time.Now()
 	nd, err := core.Resolve(ctx, i.node, path.Path(urlPath))
+	timing.record("resolve", resolveStart)
 	if err != nil {
 		webError(w, "Path Resolve error", err, http.StatusBadRequest)
 		return
 	}
 
+	if k, err := nd.Key(); err == nil {
+		setResolvedCid(w, k)
+	}
+
 	etag := gopath.Base(urlPath)
 	if r.Header.Get("If-None-Match") == etag {
 		w.WriteHeader(http.StatusNotModified)
@@ -130,6 +399,19 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 	i.addUserHeaders(w) // ok, _now_ write user's headers.
 	w.Header().Set("X-IPFS-Path", urlPath)
 
+	if wantsCAR(r) {
+		rootKey, err := nd.Key()
+		if err != nil {
+			internalWebError(w, err)
+			return
+		}
+		timing.writeHeader(w)
+		if err := i.serveCAR(ctx, w, r, nd, rootKey); err != nil {
+			internalWebError(w, err)
+		}
+		return
+	}
+
 	// Suborigin header, sandboxes apps from each other in the browser (even
 	// though they are served from the same gateway domain).
 	//
@@ -143,13 +425,48 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		w.Header().Set("Suborigin", pathRoot)
 	}
 
+	format := explicitIPLDFormat(r)
+
+	dagreadStart := time.Now()
 	dr, err := uio.NewDagReader(ctx, nd, i.node.DAG)
+	timing.record("dagread", dagreadStart)
 	if err != nil && err != uio.ErrIsDir {
-		// not a directory and still an error
+		// Not a UnixFS file or directory, so uio.NewDagReader can't make
+		// sense of it: serve the raw IPLD block instead, in whichever codec
+		// was explicitly requested (?format=/Accept), or "raw" if neither
+		// named one.
+		//
+		// This has to come after the uio.NewDagReader attempt, not before
+		// it: an explicit ?format=raw (or Accept: application/vnd.ipld.raw)
+		// against an ordinary, multi-chunk UnixFS file would otherwise
+		// short-circuit straight to nd.Data -- the root dag-pb node's own
+		// (empty or partial) data segment -- instead of either the
+		// reconstructed file or a real error.
+		if format == "" {
+			format = "raw"
+		}
+		timing.writeHeader(w)
+		if serveErr := i.serveIPLDCodec(w, r, nd, format); serveErr == nil {
+			return
+		}
 		internalWebError(w, err)
 		return
 	}
 
+	if err == uio.ErrIsDir && wantsTar(r) {
+		rootKey, keyErr := nd.Key()
+		if keyErr != nil {
+			internalWebError(w, keyErr)
+			return
+		}
+		timing.writeHeader(w)
+		name := gopath.Base(strings.TrimSuffix(urlPath, "/"))
+		if tarErr := i.serveTar(ctx, w, r, nd, rootKey, name); tarErr != nil {
+			internalWebError(w, tarErr)
+		}
+		return
+	}
+
 	// set these headers _after_ the error, for we may just not have it
 	// and dont want the client to cache a 500 response...
 	// and only if it's /ipfs!
@@ -166,7 +483,11 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 	if err == nil {
 		defer dr.Close()
 		_, name := gopath.Split(urlPath)
-		http.ServeContent(w, r, name, modtime, dr)
+		serveStart := time.Now()
+		timing.declareTrailer(w)
+		http.ServeContent(&noContentLengthWriter{ResponseWriter: w}, r, name, modtime, dr)
+		timing.record("serve", serveStart)
+		timing.flush(w)
 		return
 	}
 
@@ -181,6 +502,7 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 
 			if urlPath[len(urlPath)-1] != '/' {
 				// See comment above where originalURLPath is declared.
+				timing.writeHeader(w)
 				http.Redirect(w, r, originalURLPath+"/", 302)
 				log.Debugf("redirect to %s", originalURLPath+"/")
 				return
@@ -200,9 +522,13 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 			defer dr.Close()
 
 			// write to request
+			serveStart := time.Now()
+			timing.declareTrailer(w)
 			if r.Method != "HEAD" {
 				io.Copy(w, dr)
 			}
+			timing.record("serve", serveStart)
+			timing.flush(w)
 			break
 		}
 
@@ -251,15 +577,35 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 				Path:     originalURLPath,
 				BackLink: backLink,
 			}
+			serveStart := time.Now()
+			timing.declareTrailer(w)
 			err := listingTemplate.Execute(w, tplData)
+			timing.record("serve", serveStart)
+			timing.flush(w)
 			if err != nil {
 				internalWebError(w, err)
 				return
 			}
+		} else {
+			timing.writeHeader(w)
 		}
 	}
 }
 
+// NOT IMPLEMENTED, NEEDS A SCOPE DECISION: the request also asks for this
+// handler (and putHandler/deleteHandler below) to take a
+// coreiface.CoreAPI/NodeAPI instead of *core.IpfsNode, so the gateway can be
+// reused outside kubo. That part hasn't been done, and isn't a small
+// follow-up: coreiface is built entirely on top of the cid package's CIDv1,
+// and every handler here, and core.Resolve itself, is still wired to the
+// legacy blocks/key.Key multihash. Doing it properly means migrating that
+// resolver first, which is its own project, not something to half-do under
+// this request.
+//
+// Flagging this back to whoever filed the request rather than quietly
+// merging the rest of it as "done": please confirm whether landing the
+// MFS/PutNode/Mkdir/Rm rework alone is acceptable for now, with the
+// coreiface signature change tracked as a separate follow-up request.
 func (i *gatewayHandler) postHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	rootPath, err := path.ParsePath(r.URL.Path)
 	if err != nil {
@@ -285,59 +631,106 @@ func (i *gatewayHandler) postHandler(ctx context.Context, w http.ResponseWriter,
 		newnode = putNode
 	}
 
-	var newPath string
-	if len(rsegs) > 1 {
-		newPath = gopath.Join(rsegs[2:]...)
+	newkey, newPath, err := i.mfsPut(ctx, rsegs, newnode)
+	if err != nil {
+		webError(w, "postHandler: mfs put failed", err, http.StatusInternalServerError)
+		return
 	}
+	setResolvedCid(w, newkey)
+	log.Debugf("postHandler: wrote %s at %s", newkey, newPath)
 
-	var newkey key.Key
-	rnode, err := core.Resolve(ctx, i.node, rootPath)
-	switch ev := err.(type) {
-	case path.ErrNoLink:
-		// ev.Node < node where resolve failed
-		// ev.Name < new link
-		// but we need to patch from the root
-		rnode, err := i.node.DAG.Get(ctx, key.B58KeyDecode(rsegs[1]))
-		if err != nil {
-			webError(w, "postHandler: Could not create DAG from request", err, http.StatusInternalServerError)
-			return
-		}
+	i.addUserHeaders(w) // ok, _now_ write user's headers.
+	w.Header().Set("IPFS-Hash", newkey.String())
+	http.Redirect(w, r, gopath.Join(ipfsPathPrefix, newkey.String(), newPath), http.StatusCreated)
+}
 
-		e := dagutils.NewDagEditor(i.node.DAG, rnode)
-		err = e.InsertNodeAtPath(ctx, newPath, newnode, uio.NewEmptyDirectory)
-		if err != nil {
-			webError(w, "postHandler: InsertNodeAtPath failed", err, http.StatusInternalServerError)
-			return
-		}
+// putHandler replaces whatever lives at the request path with the body's
+// DAG. Unlike postHandler it has no empty-directory sentinel: PUT is just
+// "put this node at this path", the same mfsPut that backs POST.
+func (i *gatewayHandler) putHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	rootPath, err := path.ParsePath(r.URL.Path)
+	if err != nil {
+		webError(w, "putHandler: ipfs path not valid", err, http.StatusBadRequest)
+		return
+	}
 
-		newkey, err = e.GetNode().Key()
-		if err != nil {
-			webError(w, "postHandler: could not get key of edited node", err, http.StatusInternalServerError)
-			return
-		}
+	rsegs := rootPath.Segments()
+	if rsegs[0] == ipnsPathPrefix {
+		webError(w, "putHandler: updating named entries not supported", ErrIPNSNotSupported, http.StatusBadRequest)
+		return
+	}
 
-	case nil:
-		// object set-data case
-		rnode.Data = newnode.Data
+	newnode, err := i.newDagFromReader(r.Body)
+	if err != nil {
+		webError(w, "putHandler: Could not create DAG from request", err, http.StatusInternalServerError)
+		return
+	}
 
-		newkey, err = i.node.DAG.Add(rnode)
-		if err != nil {
-			nnk, _ := newnode.Key()
-			rk, _ := rnode.Key()
-			webError(w, fmt.Sprintf("postHandler: Could not add newnode(%q) to root(%q)", nnk.B58String(), rk.B58String()), err, http.StatusInternalServerError)
-			return
-		}
-	default:
-		log.Warningf("postHandler: unhandled resolve error %T", ev)
-		webError(w, "could not resolve root DAG", ev, http.StatusInternalServerError)
+	newkey, newPath, err := i.mfsPut(ctx, rsegs, newnode)
+	if err != nil {
+		webError(w, "putHandler: mfs put failed", err, http.StatusInternalServerError)
 		return
 	}
+	setResolvedCid(w, newkey)
+	log.Debugf("putHandler: wrote %s at %s", newkey, newPath)
 
 	i.addUserHeaders(w) // ok, _now_ write user's headers.
 	w.Header().Set("IPFS-Hash", newkey.String())
 	http.Redirect(w, r, gopath.Join(ipfsPathPrefix, newkey.String(), newPath), http.StatusCreated)
 }
 
+// mfsPut builds an in-memory MFS root from the object named by rsegs[1],
+// writes newnode at the remaining path segments, and flushes. Building on
+// MFS instead of a one-off dagutils.DagEditor means large sharded
+// directories get edited as HAMT shards rather than rewritten as a single
+// flat node.
+func (i *gatewayHandler) mfsPut(ctx context.Context, rsegs []string, newnode *dag.Node) (key.Key, string, error) {
+	rnode, err := i.node.DAG.Get(ctx, key.B58KeyDecode(rsegs[1]))
+	if err != nil {
+		return "", "", err
+	}
+
+	root, err := mfs.NewRoot(ctx, i.node.DAG, rnode, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	var newPath string
+	if len(rsegs) > 2 {
+		newPath = gopath.Join(rsegs[2:]...)
+	}
+
+	// mfs.PutNode looks up the parent directory and doesn't create missing
+	// intermediate ones, unlike the dagutils.DagEditor this replaces (its
+	// uio.NewEmptyDirectory callback auto-vivified them). Mkdir first so a
+	// POST/PUT under a not-yet-existing subdirectory keeps working.
+	if dir := gopath.Dir(newPath); dir != "." && dir != "/" {
+		if err := mfs.Mkdir(root, dir, mfs.MkdirOpts{Mkparents: true}); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := mfs.PutNode(root, newPath, newnode); err != nil {
+		return "", "", err
+	}
+
+	if err := root.Flush(); err != nil {
+		return "", "", err
+	}
+
+	rootNode, err := root.GetValue().GetNode()
+	if err != nil {
+		return "", "", err
+	}
+
+	newkey, err := rootNode.Key()
+	if err != nil {
+		return "", "", err
+	}
+
+	return newkey, newPath, nil
+}
+
 var (
 	ErrIPNSNotSupported        = errors.New("writableGateway: /ipns/ not supported")
 	ErrNotMeaningfulOnWritable = errors.New("writableGateway: non-meaningful request")
@@ -371,25 +764,425 @@ func (i *gatewayHandler) deleteHandler(ctx context.Context, w http.ResponseWrite
 		return
 	}
 
+	root, err := mfs.NewRoot(ctx, i.node.DAG, rnode, nil)
+	if err != nil {
+		webError(w, "deleteHandler: could not construct MFS root", err, http.StatusInternalServerError)
+		return
+	}
+
 	newPath := gopath.Join(rsegs[2:]...)
+	if err := mfs.Rm(root, newPath); err != nil {
+		webError(w, "deleteHandler: mfs rm failed", err, http.StatusInternalServerError)
+		return
+	}
 
-	e := dagutils.NewDagEditor(i.node.DAG, rnode)
-	if err := e.RmLink(ctx, newPath); err != nil {
-		webError(w, "deleteHandler: dag editor failed to rmLink()", err, http.StatusInternalServerError)
+	if err := root.Flush(); err != nil {
+		webError(w, "deleteHandler: could not flush MFS root", err, http.StatusInternalServerError)
 		return
 	}
 
-	newkey, err := e.GetNode().Key()
+	rootNode, err := root.GetValue().GetNode()
 	if err != nil {
 		webError(w, "deleteHandler: could not get key of edited node", err, http.StatusInternalServerError)
 		return
 	}
 
+	newkey, err := rootNode.Key()
+	if err != nil {
+		webError(w, "deleteHandler: could not get key of edited node", err, http.StatusInternalServerError)
+		return
+	}
+	setResolvedCid(w, newkey)
+	log.Debugf("deleteHandler: removed %s, new root %s", newPath, newkey)
+
 	i.addUserHeaders(w) // ok, _now_ write user's headers.
 	w.Header().Set("IPFS-Hash", newkey.String())
 	http.Redirect(w, r, gopath.Join(ipfsPathPrefix, newkey.String(), newPath), http.StatusCreated)
 }
 
+// explicitIPLDFormat returns the codec format ("raw", "dag-json" or
+// "dag-cbor") requested via ?format= or an Accept header naming one of the
+// application/vnd.ipld.* media types, or "" if neither was given.
+func explicitIPLDFormat(r *http.Request) string {
+	switch f := r.URL.Query().Get("format"); f {
+	case "raw", "dag-json", "dag-cbor":
+		return f
+	}
+	for _, accept := range r.Header["Accept"] {
+		switch {
+		case strings.Contains(accept, "application/vnd.ipld.dag-json"):
+			return "dag-json"
+		case strings.Contains(accept, "application/vnd.ipld.dag-cbor"):
+			return "dag-cbor"
+		case strings.Contains(accept, "application/vnd.ipld.raw"):
+			return "raw"
+		}
+	}
+	return ""
+}
+
+// serveIPLDCodec serves nd in the requested codec, for paths that resolve
+// to a raw IPLD block rather than a UnixFS file (uio.NewDagReader errors on
+// those). format is whatever explicitIPLDFormat (or its "raw" fallback)
+// already decided; this tree predates the cid package's multicodec prefix,
+// so we can't read the codec off the CID itself the way a newer gateway
+// would.
+func (i *gatewayHandler) serveIPLDCodec(w http.ResponseWriter, r *http.Request, nd *dag.Node, format string) error {
+	// An explicit ?format= query param is a deliberate override and should
+	// win over a browser's default Accept: text/html -- otherwise a request
+	// like "?format=dag-json" made from a browser address bar would always
+	// get the HTML view instead of the codec it asked for by name. Only the
+	// implicit case (format decided by an Accept: application/vnd.ipld.*
+	// header, or the "raw" fallback) defers to text/html.
+	if r.URL.Query().Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return i.serveIPLDCodecHTML(w, r, nd)
+	}
+
+	switch format {
+	case "raw":
+		w.Header().Set("Content-Type", "application/vnd.ipld.raw")
+		if r.Method == "HEAD" {
+			return nil
+		}
+		_, err := w.Write(nd.Data)
+		return err
+	case "dag-json":
+		w.Header().Set("Content-Type", "application/vnd.ipld.dag-json")
+		if r.Method == "HEAD" {
+			return nil
+		}
+		return json.NewEncoder(w).Encode(newIPLDCodecView(nd))
+	case "dag-cbor":
+		w.Header().Set("Content-Type", "application/vnd.ipld.dag-cbor")
+		if r.Method == "HEAD" {
+			return nil
+		}
+		_, err := w.Write(encodeIPLDCodecViewCBOR(nd))
+		return err
+	default:
+		w.WriteHeader(http.StatusNotAcceptable)
+		_, err := fmt.Fprintf(w, "unsupported format %q", format)
+		return err
+	}
+}
+
+// serveIPLDCodecHTML renders a minimal link-navigable view of nd for
+// browsers, mirroring the existing directory listing template.
+func (i *gatewayHandler) serveIPLDCodecHTML(w http.ResponseWriter, r *http.Request, nd *dag.Node) error {
+	w.Header().Set("Content-Type", "text/html")
+	if r.Method == "HEAD" {
+		return nil
+	}
+
+	fmt.Fprint(w, "<pre>\n")
+	for _, link := range nd.Links {
+		k := key.Key(link.Hash)
+		fmt.Fprintf(w, "<a href=\"%s%s\">%s</a>\t%s\n",
+			ipfsPathPrefix, html.EscapeString(k.B58String()), html.EscapeString(link.Name), humanize.Bytes(link.Size))
+	}
+	fmt.Fprint(w, "</pre>\n")
+	return nil
+}
+
+// ipldCodecView is the JSON-friendly shape used to render a raw node's
+// links (for in-browser/client navigation) and opaque data segment.
+type ipldCodecView struct {
+	Links []ipldCodecLink `json:"links,omitempty"`
+	Data  []byte          `json:"data,omitempty"`
+}
+
+type ipldCodecLink struct {
+	Name string  `json:"name"`
+	Size uint64  `json:"size"`
+	Hash cidLink `json:"hash"`
+}
+
+// cidLink is the {"/": "<cid>"} convention this codebase already uses
+// wherever a CID-valued field is rendered as JSON (see `ipfs dag get` and
+// `ipfs refs`), so a dag-json consumer recognizes the field as a link and
+// not just an opaque string.
+type cidLink struct {
+	CID string `json:"/"`
+}
+
+func newIPLDCodecView(nd *dag.Node) ipldCodecView {
+	v := ipldCodecView{Data: nd.Data}
+	for _, link := range nd.Links {
+		v.Links = append(v.Links, ipldCodecLink{
+			Name: link.Name,
+			Size: link.Size,
+			Hash: cidLink{CID: key.Key(link.Hash).B58String()},
+		})
+	}
+	return v
+}
+
+// encodeIPLDCodecViewCBOR hand-encodes the same {links,data} view as
+// newIPLDCodecView, in DAG-CBOR, reusing the minimal CBOR encoder
+// writeCARHeader needs for the CARv1 header -- this tree has no general
+// CBOR codec dependency to reach for instead. Each link's hash is tagged
+// CID(42), same representation as the CAR header's root.
+func encodeIPLDCodecViewCBOR(nd *dag.Node) []byte {
+	var buf bytes.Buffer
+	buf.Write(cborHead(5, 2)) // map(2): data, links
+
+	buf.Write(cborTextString("data"))
+	buf.Write(cborByteString(nd.Data))
+
+	buf.Write(cborTextString("links"))
+	buf.Write(cborHead(4, uint64(len(nd.Links)))) // array(len(links))
+	for _, link := range nd.Links {
+		buf.Write(cborHead(5, 3)) // map(3): hash, name, size
+		buf.Write(cborTextString("hash"))
+		buf.Write(cborHead(6, 42)) // tag(42): CID, per the DAG-CBOR spec
+		buf.Write(cborByteString(append([]byte{0x00}, cidv1Bytes(key.Key(link.Hash))...)))
+		buf.Write(cborTextString("name"))
+		buf.Write(cborTextString(link.Name))
+		buf.Write(cborTextString("size"))
+		buf.Write(cborHead(0, link.Size))
+	}
+	return buf.Bytes()
+}
+
+// wantsTar reports whether the request asked for a tar archive, either via
+// the ?format=tar query parameter or an Accept: application/x-tar header.
+func wantsTar(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "tar" {
+		return true
+	}
+	for _, accept := range r.Header["Accept"] {
+		if strings.Contains(accept, "application/x-tar") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTar streams a tar archive of the UnixFS subtree rooted at nd, named
+// after root, so a whole site or dataset can be grabbed with a single GET
+// instead of crawling links one at a time. It pairs with serveCAR for the
+// "give me the whole thing" use case, trading block-level verifiability for
+// a familiar archive format.
+func (i *gatewayHandler) serveTar(ctx context.Context, w http.ResponseWriter, r *http.Request, nd *dag.Node, root key.Key, name string) error {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", root.B58String()+".tar"))
+
+	if r.Method == "HEAD" {
+		return nil
+	}
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	return i.writeTarNode(ctx, tw, nd, name)
+}
+
+// writeTarNode writes name (and, if it's a directory, everything beneath
+// it) into tw. Files are streamed through uio.NewDagReader the same way
+// getOrHeadHandler serves a single file; directories recurse depth-first.
+// This tree's UnixFS nodes carry no mode/mtime metadata (that came along
+// much later), so every entry gets the same defaults getOrHeadHandler
+// already uses for its Etag/Cache-Control handling: files immutable,
+// "created" at modtime 1.
+//
+// NOT IMPLEMENTED: the request also asks for a tar.Header per symlink, but
+// this is only ever TypeReg or TypeDir. This tree's UnixFS predates
+// symlinks entirely -- there's no Data_Symlink (or equivalent) in the
+// unixfs protobuf at this point in the codebase's history for
+// uio.NewDagReader/nd.Links to expose one through, so there's nothing here
+// to recurse into or tar up. Calling this out explicitly rather than
+// leaving it an unremarked gap: if symlink support lands in unixfs later,
+// this needs a third branch.
+func (i *gatewayHandler) writeTarNode(ctx context.Context, tw *tar.Writer, nd *dag.Node, name string) error {
+	dr, err := uio.NewDagReader(ctx, nd, i.node.DAG)
+	if err != nil && err != uio.ErrIsDir {
+		return err
+	}
+
+	if err == nil {
+		defer dr.Close()
+		size, err := dr.Size()
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     int64(size),
+			Mode:     0644,
+			ModTime:  time.Unix(1, 0),
+		}); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, dr)
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  time.Unix(1, 0),
+	}); err != nil {
+		return err
+	}
+
+	for _, link := range nd.Links {
+		child, err := i.node.DAG.Get(ctx, key.Key(link.Hash))
+		if err != nil {
+			return err
+		}
+		if err := i.writeTarNode(ctx, tw, child, gopath.Join(name, link.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// carContentType is the response Content-Type for a CARv1 archive, see
+// https://github.com/ipld/specs/blob/master/block-layer/content-addressable-archives.md
+const carContentType = "application/vnd.ipld.car; version=1"
+
+// wantsCAR reports whether the request asked for a CAR archive, either via
+// the ?format=car query parameter or an Accept: application/vnd.ipld.car
+// header.
+func wantsCAR(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "car" {
+		return true
+	}
+	for _, accept := range r.Header["Accept"] {
+		if strings.Contains(accept, "application/vnd.ipld.car") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCAR streams a deterministic CARv1 archive of the DAG rooted at nd, so
+// a client can fetch raw blocks and verify their hashes locally instead of
+// trusting the gateway's UnixFS reconstruction (useful for migrations and
+// light-client verification).
+func (i *gatewayHandler) serveCAR(ctx context.Context, w http.ResponseWriter, r *http.Request, nd *dag.Node, root key.Key) error {
+	w.Header().Set("Content-Type", carContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", root.B58String()+".car"))
+
+	if r.Method == "HEAD" {
+		return nil
+	}
+
+	if err := writeCARHeader(w, root); err != nil {
+		return err
+	}
+
+	return i.writeCARNode(ctx, w, nd, root, map[key.Key]bool{})
+}
+
+// writeCARHeader writes the archive's root section: a DAG-CBOR-encoded
+// {"roots":[CID],"version":1} map, per the CARv1 spec linked above. This
+// codebase predates any IPLD codec package, so there's no general CBOR
+// encoder to reach for -- the map has exactly two known keys, so it's
+// hand-rolled directly against the CBOR spec instead.
+func writeCARHeader(w io.Writer, root key.Key) error {
+	var buf bytes.Buffer
+	buf.Write(cborHead(5, 2)) // map(2)
+
+	buf.Write(cborTextString("roots"))
+	buf.Write(cborHead(4, 1))  // array(1)
+	buf.Write(cborHead(6, 42)) // tag(42): CID, per the DAG-CBOR spec
+	buf.Write(cborByteString(append([]byte{0x00}, cidv1Bytes(root)...)))
+
+	buf.Write(cborTextString("version"))
+	buf.Write(cborHead(0, 1)) // uint(1)
+
+	return writeCARSection(w, buf.Bytes())
+}
+
+// cidv1Bytes synthesizes CIDv1 bytes (version || codec || multihash) from a
+// legacy key.Key. This tree predates the cid package, so there's no real
+// multicodec recorded anywhere for it to read back; dag-pb (0x70) is the
+// only one this gateway ever produces, so that's what's assumed here.
+func cidv1Bytes(k key.Key) []byte {
+	return append([]byte{0x01, 0x70}, []byte(k)...)
+}
+
+// cborHead encodes a CBOR major type + argument pair (RFC 7049 ยง2.1). Major
+// types used here: 0 (uint), 2 (byte string), 3 (text string), 4 (array),
+// 5 (map), 6 (tag).
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	case n <= 0xffffffff:
+		b := make([]byte, 5)
+		b[0] = major<<5 | 26
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	default:
+		b := make([]byte, 9)
+		b[0] = major<<5 | 27
+		binary.BigEndian.PutUint64(b[1:], n)
+		return b
+	}
+}
+
+func cborTextString(s string) []byte {
+	return append(cborHead(3, uint64(len(s))), []byte(s)...)
+}
+
+func cborByteString(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func writeCARSection(w io.Writer, data []byte) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(data)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// writeCARNode writes nd and recurses into its links, skipping any key
+// already present in seen so a DAG with shared subtrees is emitted exactly
+// once per block. Each block is keyed by its synthetic CIDv1 (cidv1Bytes),
+// matching the root CID in the header, rather than the bare legacy
+// multihash -- standard CAR readers expect a CID, not a raw multihash.
+func (i *gatewayHandler) writeCARNode(ctx context.Context, w io.Writer, nd *dag.Node, k key.Key, seen map[key.Key]bool) error {
+	if seen[k] {
+		return nil
+	}
+	seen[k] = true
+
+	data, err := nd.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := writeCARSection(w, append(cidv1Bytes(k), data...)); err != nil {
+		return err
+	}
+
+	for _, link := range nd.Links {
+		childKey := key.Key(link.Hash)
+		if seen[childKey] {
+			continue
+		}
+		child, err := i.node.DAG.Get(ctx, childKey)
+		if err != nil {
+			return err
+		}
+		if err := i.writeCARNode(ctx, w, child, childKey, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (i *gatewayHandler) addUserHeaders(w http.ResponseWriter) {
 	for k, v := range i.config.Headers {
 		w.Header()[k] = v
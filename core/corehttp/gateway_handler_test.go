@@ -0,0 +1,191 @@
+package corehttp
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	key "github.com/ipfs/go-ipfs/blocks/key"
+)
+
+func TestCborHead(t *testing.T) {
+	cases := []struct {
+		major byte
+		n     uint64
+		want  []byte
+	}{
+		{0, 0, []byte{0x00}},
+		{0, 23, []byte{0x17}},
+		{3, 24, []byte{0x3<<5 | 24, 0x18}},
+		{2, 0xff, []byte{0x2<<5 | 24, 0xff}},
+		{4, 0x100, []byte{0x4<<5 | 25, 0x01, 0x00}},
+		{5, 0x10000, []byte{0x5<<5 | 26, 0x00, 0x01, 0x00, 0x00}},
+		{6, 42, []byte{0x6<<5 | 24, 42}},
+	}
+	for _, c := range cases {
+		got := cborHead(c.major, c.n)
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("cborHead(%d, %d) = % x, want % x", c.major, c.n, got, c.want)
+		}
+	}
+}
+
+func TestCborTextString(t *testing.T) {
+	got := cborTextString("version")
+	want := append(cborHead(3, 7), []byte("version")...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("cborTextString(%q) = % x, want % x", "version", got, want)
+	}
+}
+
+func TestCborByteString(t *testing.T) {
+	data := []byte{0xde, 0xad, 0xbe, 0xef}
+	got := cborByteString(data)
+	want := append(cborHead(2, uint64(len(data))), data...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("cborByteString(% x) = % x, want % x", data, got, want)
+	}
+}
+
+func TestCidv1Bytes(t *testing.T) {
+	k := key.Key("abc")
+	got := cidv1Bytes(k)
+	want := []byte{0x01, 0x70, 'a', 'b', 'c'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("cidv1Bytes(%q) = % x, want % x", k, got, want)
+	}
+}
+
+func TestWantsCAR(t *testing.T) {
+	cases := []struct {
+		name   string
+		url    string
+		accept string
+		want   bool
+	}{
+		{"query param", "/ipfs/foo?format=car", "", true},
+		{"accept header", "/ipfs/foo", "application/vnd.ipld.car", true},
+		{"neither", "/ipfs/foo", "text/html", false},
+		{"unrelated query param", "/ipfs/foo?format=tar", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+c.url, nil)
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+			if got := wantsCAR(req); got != c.want {
+				t.Errorf("wantsCAR(%s) = %v, want %v", c.url, got, c.want)
+			}
+		})
+	}
+}
+
+func TestExplicitIPLDFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		url    string
+		accept string
+		want   string
+	}{
+		{"query param wins", "/ipfs/foo?format=dag-json", "application/vnd.ipld.raw", "dag-json"},
+		{"raw via accept", "/ipfs/foo", "application/vnd.ipld.raw", "raw"},
+		{"dag-cbor via accept", "/ipfs/foo", "application/vnd.ipld.dag-cbor", "dag-cbor"},
+		{"unrelated query param ignored", "/ipfs/foo?format=tar", "", ""},
+		{"nothing requested", "/ipfs/foo", "text/html", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+c.url, nil)
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+			if got := explicitIPLDFormat(req); got != c.want {
+				t.Errorf("explicitIPLDFormat(%s) = %q, want %q", c.url, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseSubdomainHost(t *testing.T) {
+	const gatewayHost = "gateway.example.com"
+
+	cases := []struct {
+		host   string
+		wantID string
+		wantNS string
+		wantOK bool
+	}{
+		{"bafyabc.ipfs.gateway.example.com", "bafyabc", "ipfs", true},
+		{"somename.ipns.gateway.example.com", "somename", "ipns", true},
+		{"gateway.example.com", "", "", false},
+		{"bafyabc.ipfs.other.example.com", "", "", false},
+		{"bafyabc.nope.gateway.example.com", "", "", false},
+		{"too.many.labels.ipfs.gateway.example.com", "", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.host, func(t *testing.T) {
+			gotID, gotNS, gotOK := parseSubdomainHost(c.host, gatewayHost)
+			if gotID != c.wantID || gotNS != c.wantNS || gotOK != c.wantOK {
+				t.Errorf("parseSubdomainHost(%q, %q) = (%q, %q, %v), want (%q, %q, %v)",
+					c.host, gatewayHost, gotID, gotNS, gotOK, c.wantID, c.wantNS, c.wantOK)
+			}
+		})
+	}
+}
+
+func TestSubdomainEncodeDecode(t *testing.T) {
+	k := key.Key("QmSomeExampleMultihashBytes")
+	encoded := subdomainEncode(k)
+
+	if encoded != strings.ToLower(encoded) {
+		t.Errorf("subdomainEncode(%q) = %q, want all-lowercase", k, encoded)
+	}
+
+	decoded, err := subdomainDecode(encoded)
+	if err != nil {
+		t.Fatalf("subdomainDecode(%q) returned error: %v", encoded, err)
+	}
+	if decoded != k {
+		t.Errorf("subdomainDecode(subdomainEncode(%q)) = %q, want %q", k, decoded, k)
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	cases := map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": "example.com",
+		"localhost:5001":   "localhost",
+	}
+	for in, want := range cases {
+		if got := stripPort(in); got != want {
+			t.Errorf("stripPort(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWantsTar(t *testing.T) {
+	cases := []struct {
+		name   string
+		url    string
+		accept string
+		want   bool
+	}{
+		{"query param", "/ipfs/foo?format=tar", "", true},
+		{"accept header", "/ipfs/foo", "application/x-tar", true},
+		{"neither", "/ipfs/foo", "text/html", false},
+		{"unrelated query param", "/ipfs/foo?format=car", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+c.url, nil)
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+			if got := wantsTar(req); got != c.want {
+				t.Errorf("wantsTar(%s) = %v, want %v", c.url, got, c.want)
+			}
+		})
+	}
+}